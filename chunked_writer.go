@@ -0,0 +1,474 @@
+package nsdriver
+
+// ChunkedNetstorageWriter streams a FileWriter's Write() calls into
+// rolling chunks uploaded to NetStorage as they fill, instead of
+// buffering the whole blob on local disk until Commit the way
+// LocalTempFileWriter does. While writing, local disk usage is bounded
+// by the chunk being filled plus the chunks still uploading. Commit
+// does not assemble the object on the server: it downloads every chunk
+// into one local file and uploads that, so it needs local space for
+// the whole blob. An interrupted upload can resume from its last
+// committed chunk instead of restarting at offset 0.
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/uuid"
+)
+
+const (
+	// defaultChunkSize is the size of each scratch chunk uploaded to
+	// NetStorage before the final assembly pass.
+	defaultChunkSize = 16 * 1024 * 1024
+	// defaultUploadConcurrency bounds how many chunks are in flight to
+	// NetStorage at once.
+	defaultUploadConcurrency = 4
+	// defaultUploadTTL is how long an abandoned .upload/ scratch
+	// prefix is kept around before GCUploads reclaims it.
+	defaultUploadTTL = 24 * time.Hour
+
+	manifestName = "manifest.json"
+)
+
+// chunkManifest is the sidecar JSON that records the scratch chunks
+// belonging to one in-progress or interrupted upload, so a later
+// append can find where to resume, and GCUploads can tell an
+// abandoned upload from a running one.
+type chunkManifest struct {
+	Dest      string   `json:"dest"`
+	Uuid      string   `json:"uuid"`
+	Chunks    []string `json:"chunks"`
+	Size      int64    `json:"size"`
+	StartedAt int64    `json:"startedAt"`
+}
+
+// scratchPrefix is the NetStorage path under which an upload's chunks
+// and manifest live until Commit assembles them into dest.
+func scratchPrefix(dest, id string) string {
+	return dest + ".upload/" + id + "/"
+}
+
+// ChunkedNetstorageWriter implements TempFileWriter by buffering one
+// chunk at a time locally while writing, uploading finished chunks to a
+// scratch prefix on NetStorage, and on Commit downloading those chunks
+// into a local file that is uploaded as the final object.
+type ChunkedNetstorageWriter struct {
+	ctx  context.Context
+	d    *Driver
+	dest string
+
+	uuid              string
+	scratch           string
+	chunkSize         int64
+	uploadConcurrency int
+
+	mu        sync.Mutex
+	buf       *os.File
+	bufSize   int64
+	chunks    []string
+	committed int64
+	sem       chan struct{}
+	wg        sync.WaitGroup
+	uploadErr error
+	closed    bool
+
+	// sha256/md5 run over every byte as it is written, so Commit can
+	// assemble and hash-verify the final object without ever reading
+	// the whole blob back into local memory a second time.
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+// ChunkedNetstorageWriterFunc is a TempFileFunc that streams uploads
+// through ChunkedNetstorageWriter. It is the driver's default.
+func ChunkedNetstorageWriterFunc(ctx context.Context, d *Driver, dest string, append bool) (TempFileWriter, error) {
+	chunkSize := int64(defaultChunkSize)
+	if s, ok := d.Options["chunkSize"]; ok {
+		if n, err := strconv.ParseInt(fmt.Sprint(s), 10, 64); err == nil && n > 0 {
+			chunkSize = n
+		}
+	}
+	concurrency := defaultUploadConcurrency
+	if s, ok := d.Options["uploadConcurrency"]; ok {
+		if n, err := strconv.Atoi(fmt.Sprint(s)); err == nil && n > 0 {
+			concurrency = n
+		}
+	}
+
+	w := &ChunkedNetstorageWriter{
+		ctx:               ctx,
+		d:                 d,
+		dest:              dest,
+		chunkSize:         chunkSize,
+		uploadConcurrency: concurrency,
+		sem:               make(chan struct{}, concurrency),
+		sha256:            sha256.New(),
+		md5:               md5.New(),
+	}
+
+	if append {
+		m, err := w.findResumableManifest()
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			w.uuid = m.Uuid
+			w.scratch = scratchPrefix(dest, m.Uuid)
+			w.chunks = m.Chunks
+			w.committed = m.Size
+			if err := w.primeHash(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if w.uuid == "" {
+		w.uuid = uuid.Generate().String()
+		w.scratch = scratchPrefix(dest, w.uuid)
+	}
+
+	buf, err := ioutil.TempFile("", "nsd-chunk")
+	if err != nil {
+		return nil, err
+	}
+	w.buf = buf
+	return w, nil
+}
+
+// primeHash replays chunks uploaded by an earlier, resumed writer
+// through the running digests, so the final hash covers bytes this
+// instance never saw written.
+func (w *ChunkedNetstorageWriter) primeHash() error {
+	sink := io.MultiWriter(w.sha256, w.md5)
+	for _, c := range w.chunks {
+		resp, err := w.d.ns.Read(w.ctx, w.scratch+c)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(sink, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findResumableManifest looks for an existing scratch manifest for
+// dest, so append=true can resume uploading from where a previous
+// writer left off.
+func (w *ChunkedNetstorageWriter) findResumableManifest() (*chunkManifest, error) {
+	st, err := w.d.ns.Dir(w.ctx, w.dest+".upload/")
+	if err != nil {
+		// No scratch directory yet means nothing to resume.
+		return nil, nil
+	}
+	var latest *chunkManifest
+	for _, f := range st.Files {
+		if !f.IsDir() {
+			continue
+		}
+		body, err := w.d.ns.submitRequest_GetBody(w.ctx, "download", "GET", scratchPrefix(w.dest, f.Name)+manifestName)
+		if err != nil {
+			continue
+		}
+		var m chunkManifest
+		if err := json.Unmarshal(body, &m); err != nil {
+			continue
+		}
+		if latest == nil || m.StartedAt > latest.StartedAt {
+			mCopy := m
+			latest = &mCopy
+		}
+	}
+	return latest, nil
+}
+
+// IsDir reports whether a StatEntry describes a directory. NetStorage
+// nests symlinks under "symlink" and directories under "dir".
+func (e StatEntry) IsDir() bool {
+	return e.Type == "dir"
+}
+
+func (w *ChunkedNetstorageWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		room := w.chunkSize - w.bufSize
+		n := int64(len(p))
+		if n > room {
+			n = room
+		}
+		chunk := p[:n]
+		written, err := w.buf.Write(chunk)
+		w.bufSize += int64(written)
+		total += written
+		if written > 0 {
+			w.sha256.Write(chunk[:written])
+			w.md5.Write(chunk[:written])
+		}
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		if w.bufSize >= w.chunkSize {
+			if err := w.flushChunk(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// flushChunk uploads the current buffer as the next chunk, bounded by
+// uploadConcurrency, and starts a fresh buffer for subsequent writes.
+func (w *ChunkedNetstorageWriter) flushChunk() error {
+	if w.bufSize == 0 {
+		return nil
+	}
+	chunkName := fmt.Sprintf("chunk-%04d", len(w.chunks))
+	chunkPath := w.scratch + chunkName
+	w.chunks = append(w.chunks, chunkName)
+	w.committed += w.bufSize
+
+	finished := w.buf
+	next, err := ioutil.TempFile("", "nsd-chunk")
+	if err != nil {
+		return err
+	}
+	w.buf = next
+	w.bufSize = 0
+
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.sem }()
+		defer os.Remove(finished.Name())
+		defer finished.Close()
+		if err := w.d.ns.Write(w.ctx, finished, chunkPath); err != nil {
+			w.mu.Lock()
+			if w.uploadErr == nil {
+				w.uploadErr = err
+			}
+			w.mu.Unlock()
+			return
+		}
+	}()
+	return w.persistManifest()
+}
+
+func (w *ChunkedNetstorageWriter) persistManifest() error {
+	m := chunkManifest{
+		Dest:      w.dest,
+		Uuid:      w.uuid,
+		Chunks:    w.chunks,
+		Size:      w.committed,
+		StartedAt: time.Now().Unix(),
+	}
+	body, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	return w.d.ns.Write(w.ctx, &sliceReadSeeker{data: body}, w.scratch+manifestName)
+}
+
+// sliceReadSeeker adapts a []byte to io.ReadSeeker, since ns.Write
+// needs to be able to rewind the body on retry.
+type sliceReadSeeker struct {
+	data []byte
+	pos  int64
+}
+
+func (s *sliceReadSeeker) Read(p []byte) (int, error) {
+	if s.pos >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.pos:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *sliceReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+		s.pos = offset
+	case 1:
+		s.pos += offset
+	case 2:
+		s.pos = int64(len(s.data)) + offset
+	}
+	return s.pos, nil
+}
+
+func (w *ChunkedNetstorageWriter) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.committed + w.bufSize
+}
+
+func (w *ChunkedNetstorageWriter) Cancel() error {
+	w.mu.Lock()
+	if w.buf != nil {
+		w.buf.Close()
+		os.Remove(w.buf.Name())
+		w.buf = nil
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	return w.deleteScratch()
+}
+
+// deleteScratch reclaims this writer's scratch prefix via
+// Driver.deleteScratchDir, unless nothing was ever flushed to it.
+func (w *ChunkedNetstorageWriter) deleteScratch() error {
+	if len(w.chunks) == 0 {
+		// Nothing was ever flushed to the scratch prefix, so there's
+		// nothing on NetStorage to clean up.
+		return nil
+	}
+	return w.d.deleteScratchDir(w.ctx, w.scratch)
+}
+
+// deleteScratchDir reclaims a scratch upload directory, honoring the
+// same EnableQuickDelete gate as Driver.Delete: quick-delete requires
+// a separate CP-code privilege most accounts don't have, so by
+// default this falls back to removing chunks one at a time instead of
+// failing on a permission error. Used by both a writer's own
+// Cancel/Commit and GCUploads' sweep of abandoned uploads.
+func (d *Driver) deleteScratchDir(ctx context.Context, scratch string) error {
+	if d.EnableQuickDelete {
+		return d.ns.QuickDelete(ctx, scratch)
+	}
+	return d.deleteTree(ctx, strings.TrimSuffix(scratch, "/"))
+}
+
+func (w *ChunkedNetstorageWriter) Close() error {
+	w.mu.Lock()
+	closed := w.closed
+	w.closed = true
+	w.mu.Unlock()
+	if closed {
+		return nil
+	}
+	if err := w.flushChunk(); err != nil {
+		return err
+	}
+	w.wg.Wait()
+	if w.buf != nil {
+		w.buf.Close()
+		os.Remove(w.buf.Name())
+		w.buf = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.uploadErr
+}
+
+// Commit downloads the chunks in order into a local scratch file and
+// uploads that as one hashed, verified object at dest, then reclaims
+// the scratch prefix. It can't stream straight from the chunk
+// downloads into the upload PUT: both ends talk to the same
+// NetStorage host, and a NetStorage fronted by a single-threaded
+// backend (or one that serializes requests, as the test fake does)
+// would deadlock with a download and an upload to the same host
+// in flight at once. The digest was accumulated chunk-by-chunk as the
+// data was originally written, so at least the hash doesn't need a
+// second read-through.
+func (w *ChunkedNetstorageWriter) Commit() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	assembled, err := ioutil.TempFile("", "nsd-assemble")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(assembled.Name())
+	defer assembled.Close()
+
+	for _, c := range w.chunks {
+		resp, err := w.d.ns.Read(w.ctx, w.scratch+c)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(assembled, resp.Body); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	sha256Hex := hex.EncodeToString(w.sha256.Sum(nil))
+	md5Hex := hex.EncodeToString(w.md5.Sum(nil))
+
+	if err := w.d.ns.WriteHashed(w.ctx, assembled, w.dest, sha256Hex, w.committed); err != nil {
+		return err
+	}
+	tmp := LocalTempFileWriter{ctx: w.ctx, d: w.d, destFileName: w.dest}
+	if err := tmp.verifyRemoteMD5(md5Hex); err != nil {
+		return err
+	}
+	return w.deleteScratch()
+}
+
+// GCUploads walks root looking for .upload/ scratch prefixes whose
+// manifest is older than ttl and reclaims them. It is meant to be
+// called once at driver startup to clean up scratch data left behind
+// by a registry process that died mid-commit.
+func (d *Driver) GCUploads(ctx context.Context, root string, ttl time.Duration) error {
+	entries, err := d.ns.Dir(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries.Files {
+		full := root + e.Name
+		if e.IsDir() {
+			if strings.HasSuffix(full, ".upload") || strings.HasSuffix(full, ".upload/") {
+				if err := d.gcUploadDir(ctx, full+"/", ttl); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.GCUploads(ctx, full+"/", ttl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Driver) gcUploadDir(ctx context.Context, uploadDir string, ttl time.Duration) error {
+	ids, err := d.ns.Dir(ctx, uploadDir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-ttl).Unix()
+	for _, id := range ids.Files {
+		body, err := d.ns.submitRequest_GetBody(ctx, "download", "GET", uploadDir+id.Name+"/"+manifestName)
+		if err != nil {
+			continue
+		}
+		var m chunkManifest
+		if err := json.Unmarshal(body, &m); err != nil {
+			continue
+		}
+		if m.StartedAt < cutoff {
+			if err := d.deleteScratchDir(ctx, uploadDir+id.Name+"/"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package nsdriver
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func newChunkedTestDriver(chunkSize int64) (*Driver, *Netstorage) {
+	_, ns := newFakeNetStorageServer("kn", "k")
+	d := &Driver{
+		ns:      ns,
+		Options: map[string]interface{}{"chunkSize": chunkSize, "uploadConcurrency": 2},
+	}
+	d.GetNameFunc = func(ctx context.Context, dd *Driver, nm string) (string, bool) { return nm, false }
+	d.TempFileFunc = ChunkedNetstorageWriterFunc
+	return d, ns
+}
+
+func TestChunkedWriterCommitAssemblesChunks(t *testing.T) {
+	d, ns := newChunkedTestDriver(8)
+	ctx := context.Background()
+
+	w, err := d.TempFileFunc(ctx, d, "/cp/foo/bar", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	content := []byte("this content is longer than one eight-byte chunk")
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Unexpected error writing: %s", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Unexpected error committing: %s", err)
+	}
+
+	resp, err := ns.Read(ctx, "/cp/foo/bar")
+	if err != nil {
+		t.Fatalf("Unexpected error reading back: %s", err)
+	}
+	defer resp.Body.Close()
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Wrong content: got %q want %q", got, content)
+	}
+}
+
+func TestChunkedWriterCancelRemovesScratch(t *testing.T) {
+	d, ns := newChunkedTestDriver(8)
+	ctx := context.Background()
+
+	w, err := d.TempFileFunc(ctx, d, "/cp/foo/baz", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := w.Write([]byte("some content across chunks")); err != nil {
+		t.Fatalf("Unexpected error writing: %s", err)
+	}
+	if err := w.Cancel(); err != nil {
+		t.Fatalf("Unexpected error cancelling: %s", err)
+	}
+
+	if _, err := ns.Stat(ctx, "/cp/foo/baz"); err == nil {
+		t.Errorf("Expected destination to not exist after cancel")
+	}
+	st, err := ns.Dir(ctx, "/cp/foo/baz.upload/")
+	if err != nil {
+		t.Fatalf("Unexpected error listing scratch uploads: %s", err)
+	}
+	if len(st.Files) != 0 {
+		t.Errorf("Expected scratch upload to be removed after cancel, found %v", st.Files)
+	}
+}
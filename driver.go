@@ -19,6 +19,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/docker/distribution/context"
@@ -58,7 +59,7 @@ type Driver struct {
 
 	// tempFileFunc should return a temp file writer using the local
 	// storage. This defaults to LocalTempFileWriter
-	TempFileFunc func(driver *Driver, nm string, append bool) (TempFileWriter, error)
+	TempFileFunc func(ctx context.Context, driver *Driver, nm string, append bool) (TempFileWriter, error)
 
 	// getNameFunc maps file names to storage file names, and decides
 	// whether the file should be in local storage or netstorage. This defaults to noop
@@ -70,6 +71,28 @@ type Driver struct {
 
 	// Options used to initialize the Driver. Driver functions may look at these parameters
 	Options map[string]interface{}
+
+	// EnableQuickDelete allows Delete to use NetStorage's
+	// quick-delete action to recursively remove a directory tree in
+	// one call. quick-delete requires a separate CP Code privilege
+	// and cannot be undone, so it defaults to false: Delete then
+	// removes a directory tree with a per-file delete loop instead.
+	EnableQuickDelete bool
+
+	// EdgeHostname is the Akamai edge hostname signed URLs are built
+	// against. It may differ from ns.Hostname, which is only used for
+	// the upload/management API. Defaults to ns.Hostname if empty.
+	EdgeHostname string
+
+	// EdgeTokenKey signs the URLs returned by URLFor. It is distinct
+	// from the upload HMAC key. URLFor returns
+	// storagedriver.ErrUnsupportedMethod when this is empty and no
+	// UrlMapperFunc is set.
+	EdgeTokenKey string
+
+	// SignedURLTTL is how long a URLFor-generated URL stays valid.
+	// Defaults to 5 minutes.
+	SignedURLTTL time.Duration
 }
 
 func init() {
@@ -129,6 +152,43 @@ func (f *nsDriverFactory) Create(parameters map[string]interface{}) (storagedriv
 		}
 		driver.ns = NewNetstorage(hostname, keyname, key, ssl)
 
+		if s, ok := parameters["enableQuickDelete"]; ok {
+			switch k := s.(type) {
+			case bool:
+				driver.EnableQuickDelete = k
+			case string:
+				driver.EnableQuickDelete, err = strconv.ParseBool(k)
+				if err != nil {
+					return nil, fmt.Errorf("invalid enableQuickDelete value %s", s)
+				}
+			default:
+				return nil, fmt.Errorf("invalid enableQuickDelete value %s", s)
+			}
+		}
+
+		if s, ok := parameters["edgeHostname"]; ok {
+			driver.EdgeHostname = fmt.Sprint(s)
+		}
+		if s, ok := parameters["edgeTokenKey"]; ok {
+			driver.EdgeTokenKey = fmt.Sprint(s)
+		}
+		if s, ok := parameters["signedURLTTL"]; ok {
+			switch k := s.(type) {
+			case string:
+				ttl, err := time.ParseDuration(k)
+				if err != nil {
+					return nil, fmt.Errorf("invalid signedURLTTL value %s", s)
+				}
+				driver.SignedURLTTL = ttl
+			default:
+				secs, err := strconv.Atoi(fmt.Sprint(s))
+				if err != nil {
+					return nil, fmt.Errorf("invalid signedURLTTL value %s", s)
+				}
+				driver.SignedURLTTL = time.Duration(secs) * time.Second
+			}
+		}
+
 		if s, ok := parameters["localDriver"]; ok {
 			if driverBlock, ok := s.(map[string]interface{}); ok {
 				if len(driverBlock) == 1 { // There can be only one local driver
@@ -153,11 +213,16 @@ func (f *nsDriverFactory) Create(parameters map[string]interface{}) (storagedriv
 		}
 	}
 	// We made it here. Set default implementation of functions, and let other driver override them
-	driver.TempFileFunc = LocalTempFileWriterFunc
+	driver.TempFileFunc = ChunkedNetstorageWriterFunc
 	driver.GetNameFunc = func(ctx context.Context, d *Driver, nm string) (string, bool) { return nm, false }
 	if overrideDriverFunc != nil {
 		overrideDriverFunc(&driver)
 	}
+	if s, ok := parameters["gcUploadsOnStart"]; ok {
+		if gc, err := strconv.ParseBool(fmt.Sprint(s)); err == nil && gc {
+			go driver.GCUploads(context.Background(), "/", defaultUploadTTL)
+		}
+	}
 	return &driver, nil
 }
 
@@ -207,8 +272,11 @@ func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 	if local {
 		return d.Local.Reader(ctx, mappedName, offset)
 	} else {
-		response, err := d.ns.Read(mappedName)
+		response, err := d.ns.Read(ctx, mappedName)
 		if err != nil {
+			if IsNotFound(err) {
+				return nil, storagedriver.PathNotFoundError{DriverName: driverName, Path: path}
+			}
 			return nil, err
 		}
 		if offset > 0 {
@@ -237,7 +305,15 @@ func (r *readFrom) Read(p []byte) (int, error) {
 		}
 		read, err := r.r.Read(buf)
 		if err != nil {
-			return int(r.seen), err
+			// The stream ended before we finished skipping to
+			// offset: the caller asked for data that isn't there.
+			// Surface that as an error instead of io.EOF, which
+			// io.ReadAll and friends treat as a normal, silent end
+			// of input.
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
 		}
 		r.seen += int64(read)
 		if read == 0 {
@@ -260,14 +336,14 @@ func (d *Driver) Writer(ctx context.Context, subPath string, append bool) (stora
 		// semantics. We can't append, or commit. So, we first write
 		// to temporary storage, and then upon commit, we copy the
 		// file to akamai
-		return d.TempFileFunc(d, subPath, append)
+		return d.TempFileFunc(ctx, d, subPath, append)
 	}
 }
 
 // LocalTempFileWriterFunc is the default implementation of the driver
 // temp file func. It uses the "tmp" option of the driver as a
 // directory to store temp files, defaults to OS default
-func LocalTempFileWriterFunc(d *Driver, path string, append bool) (TempFileWriter, error) {
+func LocalTempFileWriterFunc(ctx context.Context, d *Driver, path string, append bool) (TempFileWriter, error) {
 	var tempDir string
 	// Do we have a temp file dir?
 	if s, ok := d.Options["tmp"]; ok {
@@ -279,10 +355,11 @@ func LocalTempFileWriterFunc(d *Driver, path string, append bool) (TempFileWrite
 	if err != nil {
 		return nil, err
 	}
-	return LocalTempFileWriter{d: d, tempFileName: tempFile.Name(), tempFile: tempFile, destFileName: path}, nil
+	return LocalTempFileWriter{ctx: ctx, d: d, tempFileName: tempFile.Name(), tempFile: tempFile, destFileName: path}, nil
 }
 
 type LocalTempFileWriter struct {
+	ctx          context.Context
 	d            *Driver
 	tempFileName string
 	tempFile     *os.File
@@ -311,19 +388,89 @@ func (t LocalTempFileWriter) Cancel() error {
 	return nil
 }
 
+// hashTempFile reads f from the start, computing its size and SHA-256
+// and MD5 digests, then rewinds it so it can be streamed again.
+func hashTempFile(f *os.File) (size int64, sha256Hex string, md5Hex string, err error) {
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	hr := NewHashingReader(f)
+	size, err = io.Copy(ioutil.Discard, hr)
+	if err != nil {
+		return
+	}
+	sha256Hex = hr.SHA256Hex()
+	md5Hex = hr.MD5Hex()
+	_, err = f.Seek(0, io.SeekStart)
+	return
+}
+
+// verifyRemoteMD5 stats destFileName on NetStorage and checks that its
+// reported MD5 matches expectedMD5Hex.
+func (t LocalTempFileWriter) verifyRemoteMD5(expectedMD5Hex string) error {
+	st, err := t.d.ns.Stat(t.ctx, t.destFileName)
+	if err != nil {
+		return err
+	}
+	if len(st.Files) == 0 {
+		return fmt.Errorf("stat returned no entry for %s", t.destFileName)
+	}
+	if !strings.EqualFold(st.Files[0].MD5, expectedMD5Hex) {
+		return fmt.Errorf("remote md5 %s does not match uploaded content md5 %s", st.Files[0].MD5, expectedMD5Hex)
+	}
+	return nil
+}
+
 func (t LocalTempFileWriter) Commit() error {
-	t.tempFile.Seek(0, 0)
-	err := t.d.ns.Write(t.tempFile, t.destFileName)
 	defer func() {
 		t.tempFile.Close()
 		os.Remove(t.tempFileName)
 	}()
+
+	size, sha256Hex, md5Hex, err := hashTempFile(t.tempFile)
 	if err != nil {
 		return err
 	}
+
+	upload := func() error {
+		return t.d.ns.WriteHashed(t.ctx, t.tempFile, t.destFileName, sha256Hex, size)
+	}
+
+	if err := upload(); err != nil {
+		return err
+	}
+	if err := t.verifyRemoteMD5(md5Hex); err != nil {
+		// The upload landed but doesn't match what we sent. Give it
+		// one more try before giving up.
+		if err := upload(); err != nil {
+			return storagedriver.Error{DriverName: driverName, Enclosed: err}
+		}
+		if err := t.verifyRemoteMD5(md5Hex); err != nil {
+			return storagedriver.Error{DriverName: driverName, Enclosed: err}
+		}
+	}
 	return nil
 }
 
+// FileInfoHasher is implemented by FileInfo values returned by Driver
+// for objects stored on NetStorage, exposing the MD5 NetStorage
+// reported for the object so callers can verify content addressing
+// without a redundant local hash pass.
+type FileInfoHasher interface {
+	MD5() string
+}
+
+type nsFileInfo struct {
+	storagedriver.FileInfoInternal
+	md5 string
+}
+
+// MD5 returns the MD5 digest NetStorage reported for this file, or ""
+// for directories.
+func (f *nsFileInfo) MD5() string {
+	return f.md5
+}
+
 // Stat retrieves the FileInfo for the given path, including the current size
 // in bytes and the creation time.
 func (d *Driver) Stat(ctx context.Context, subPath string) (storagedriver.FileInfo, error) {
@@ -331,11 +478,14 @@ func (d *Driver) Stat(ctx context.Context, subPath string) (storagedriver.FileIn
 	if local {
 		return d.Local.Stat(ctx, mappedName)
 	} else {
-		st, err := d.ns.Stat(mappedName)
+		st, err := d.ns.Stat(ctx, mappedName)
 		if err != nil {
+			if IsNotFound(err) {
+				return nil, storagedriver.PathNotFoundError{DriverName: driverName, Path: subPath}
+			}
 			return nil, err
 		}
-		var ret storagedriver.FileInfoInternal
+		ret := &nsFileInfo{md5: st.Files[0].MD5}
 		ret.FileInfoFields.Path = path.Join(st.Dir, st.Files[0].Name)
 		ret.FileInfoFields.ModTime = time.Unix(int64(st.Files[0].Mtime), 0)
 		if st.Files[0].Type == "file" {
@@ -343,7 +493,7 @@ func (d *Driver) Stat(ctx context.Context, subPath string) (storagedriver.FileIn
 		} else {
 			ret.FileInfoFields.IsDir = true
 		}
-		return &ret, nil
+		return ret, nil
 	}
 }
 
@@ -354,8 +504,11 @@ func (d *Driver) List(ctx context.Context, subPath string) ([]string, error) {
 	if local {
 		return d.Local.List(ctx, mappedName)
 	} else {
-		st, err := d.ns.Dir(mappedName)
+		st, err := d.ns.Dir(ctx, mappedName)
 		if err != nil {
+			if IsNotFound(err) {
+				return nil, storagedriver.PathNotFoundError{DriverName: driverName, Path: subPath}
+			}
 			return nil, err
 		}
 		ret := make([]string, len(st.Files))
@@ -380,7 +533,7 @@ func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) e
 	case !sourceLocal && destLocal:
 		return errors.New("Cannot move remote file to local")
 	default:
-		return d.ns.Rename(mappedSource, mappedDest)
+		return d.ns.Rename(ctx, mappedSource, mappedDest)
 	}
 }
 
@@ -389,30 +542,81 @@ func (d *Driver) moveFromLocal(ctx context.Context, source, dest string) error {
 	if err != nil {
 		return err
 	}
-	err = d.ns.Write(f, dest)
-	if err != nil {
+	defer f.Close()
+	if err := d.ns.Write(ctx, f, dest); err != nil {
 		return err
 	}
-	os.Remove(dest)
-	return nil
+	return os.Remove(source)
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
+// Unless d.EnableQuickDelete is set, this walks the tree and removes
+// files and directories one at a time, since NetStorage's quick-delete
+// action requires a separate account privilege and cannot be undone.
 func (d *Driver) Delete(ctx context.Context, subPath string) error {
 	mappedName, local := d.GetNameFunc(ctx, d, subPath)
 	if local {
 		return d.Local.Delete(ctx, mappedName)
+	}
+	var err error
+	if d.EnableQuickDelete {
+		err = d.ns.QuickDelete(ctx, mappedName)
 	} else {
-		return d.ns.QuickDelete(mappedName)
+		err = d.deleteTree(ctx, mappedName)
 	}
+	if IsNotFound(err) {
+		return storagedriver.PathNotFoundError{DriverName: driverName, Path: subPath}
+	}
+	return err
 }
 
-// URLFor returns a URL which may be used to retrieve the content stored at the given path.
-// May return an UnsupportedMethodErr in certain StorageDriver implementations.
+// deleteTree removes nsPath, recursing into directories one entry at
+// a time via delete/rmdir instead of quick-delete.
+func (d *Driver) deleteTree(ctx context.Context, nsPath string) error {
+	st, err := d.ns.Stat(ctx, nsPath)
+	if err != nil {
+		return err
+	}
+	if len(st.Files) == 0 {
+		return nil
+	}
+	if st.Files[0].Type != "dir" {
+		return d.ns.Delete(ctx, nsPath)
+	}
+	entries, err := d.ns.Dir(ctx, nsPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries.Files {
+		child := path.Join(nsPath, e.Name)
+		if e.Type == "dir" {
+			if err := d.deleteTree(ctx, child); err != nil {
+				return err
+			}
+		} else if err := d.ns.Delete(ctx, child); err != nil {
+			return err
+		}
+	}
+	return d.ns.Rmdir(ctx, nsPath)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored
+// at the given path. If UrlMapperFunc is set, it takes precedence.
+// Otherwise, URLFor generates a time-limited NetStorage signed URL if
+// EdgeTokenKey is configured, and returns
+// storagedriver.ErrUnsupportedMethod if it isn't, rather than silently
+// proxying through Local. With EdgeTokenKey set, paths that GetNameFunc
+// maps to local storage are passed to Local.URLFor instead of signed.
 func (d *Driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
-	if d.UrlMapperFunc == nil {
-		return d.Local.URLFor(ctx, path, options)
-	} else {
+	if d.UrlMapperFunc != nil {
 		return d.UrlMapperFunc(ctx, d, path, options)
 	}
+	if d.EdgeTokenKey == "" {
+		return "", storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	mappedName, local := d.GetNameFunc(ctx, d, path)
+	if local {
+		return d.Local.URLFor(ctx, mappedName, options)
+	}
+	return d.signedURL(mappedName, options)
 }
@@ -1,9 +1,20 @@
 package nsdriver
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+	"github.com/docker/distribution/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
 )
 
+// Hook up gocheck into the "go test" runner, as required by testsuites.
+func Test(t *testing.T) { check.TestingT(t) }
+
 func TestCreate(t *testing.T) {
 	factory := nsDriverFactory{}
 
@@ -20,7 +31,66 @@ func TestCreate(t *testing.T) {
 	if driver.ns.Hostname != "host" ||
 		driver.ns.Keyname != "kn" ||
 		driver.ns.Key != "k" ||
-		driver.ns.Ssl != "s" {
+		driver.ns.Ssl != "" {
+		t.Errorf("Wrong values: %v", driver)
+	}
+}
+
+func TestCreateSsl(t *testing.T) {
+	factory := nsDriverFactory{}
+
+	d, err := factory.Create(map[string]interface{}{"hostname": "host",
+		"keyname": "kn", "key": "k", "ssl": false})
+	if err != nil {
+		t.Errorf("Unexpected error:%s", err)
+	}
+	driver := d.(*Driver)
+	if driver.ns.Ssl != "" {
 		t.Errorf("Wrong values: %v", driver)
 	}
 }
+
+// nopReadCloser lets a strings.Reader stand in for the response body
+// readFrom wraps.
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
+
+func TestReadFromSkipsOffset(t *testing.T) {
+	data := "0123456789"
+	rf := &readFrom{r: nopReadCloser{strings.NewReader(data)}, o: 4}
+
+	got, err := ioutil.ReadAll(rf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if string(got) != "456789" {
+		t.Errorf("Wrong content: got %q", got)
+	}
+}
+
+func TestReadFromLargeOffsetEOFMidSkip(t *testing.T) {
+	data := "short"
+	rf := &readFrom{r: nopReadCloser{strings.NewReader(data)}, o: 100}
+
+	got, err := ioutil.ReadAll(rf)
+	if err == nil {
+		t.Errorf("Expected an error reading past EOF while skipping, got content %q", got)
+	}
+}
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		_, ns := newFakeNetStorageServer("kn", "k")
+		return &Driver{
+			ns: ns,
+			GetNameFunc: func(ctx context.Context, d *Driver, nm string) (string, bool) {
+				return nm, false
+			},
+			TempFileFunc: LocalTempFileWriterFunc,
+			Options:      map[string]interface{}{},
+		}, nil
+	}, testsuites.NeverSkip)
+}
@@ -0,0 +1,44 @@
+package nsdriver
+
+// HashingReader wraps a reader and computes running SHA-256 and MD5
+// digests as it is read, so a temp file can be hashed and then
+// streamed to NetStorage without buffering the digest input twice.
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+type HashingReader struct {
+	r      io.Reader
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+// NewHashingReader wraps r, feeding every byte read through SHA-256
+// and MD5 as it passes through.
+func NewHashingReader(r io.Reader) *HashingReader {
+	return &HashingReader{r: r, sha256: sha256.New(), md5: md5.New()}
+}
+
+func (h *HashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if n > 0 {
+		h.sha256.Write(p[:n])
+		h.md5.Write(p[:n])
+	}
+	return n, err
+}
+
+// SHA256Hex returns the hex-encoded SHA-256 digest of everything read so far.
+func (h *HashingReader) SHA256Hex() string {
+	return hex.EncodeToString(h.sha256.Sum(nil))
+}
+
+// MD5Hex returns the hex-encoded MD5 digest of everything read so far.
+func (h *HashingReader) MD5Hex() string {
+	return hex.EncodeToString(h.md5.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package nsdriver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestHashingReaderDigests(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	hr := NewHashingReader(bytes.NewReader(data))
+
+	if _, err := io.Copy(ioutil.Discard, hr); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	sh := sha256.Sum256(data)
+	if hr.SHA256Hex() != hex.EncodeToString(sh[:]) {
+		t.Errorf("Wrong sha256: got %s want %s", hr.SHA256Hex(), hex.EncodeToString(sh[:]))
+	}
+
+	m := md5.Sum(data)
+	if hr.MD5Hex() != hex.EncodeToString(m[:]) {
+		t.Errorf("Wrong md5: got %s want %s", hr.MD5Hex(), hex.EncodeToString(m[:]))
+	}
+}
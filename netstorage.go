@@ -6,11 +6,11 @@ package nsdriver
 // local filesystem, not with streams
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -33,6 +33,10 @@ type Netstorage struct {
 	Key      string
 	Ssl      string
 	Client   *http.Client
+
+	// Pacer paces and retries requests on transient network and
+	// server errors. Defaults to NewPacer() in NewNetstorage.
+	Pacer *Pacer
 }
 
 type StatData struct {
@@ -67,7 +71,7 @@ func NewNetstorage(hostname, keyname, key string, ssl bool) *Netstorage {
 	if ssl {
 		s = "s"
 	}
-	return &Netstorage{hostname, keyname, key, s, http.DefaultClient}
+	return &Netstorage{hostname, keyname, key, s, http.DefaultClient, NewPacer()}
 }
 
 func readBody(response *http.Response) ([]byte, error) {
@@ -78,10 +82,19 @@ func readBody(response *http.Response) ([]byte, error) {
 	return body, nil
 }
 
+// pacer returns ns.Pacer, falling back to a fresh default pacer if the
+// struct was built without going through NewNetstorage.
+func (ns *Netstorage) pacer() *Pacer {
+	if ns.Pacer == nil {
+		ns.Pacer = NewPacer()
+	}
+	return ns.Pacer
+}
+
 // buildRequest prepares the http request by creating the
 // authorization headers with Netstorage struct values. The returned
 // request has nil body
-func (ns *Netstorage) buildRequest(action, method, nsPath string) (*http.Request, error) {
+func (ns *Netstorage) buildRequest(ctx context.Context, action, method, nsPath string) (*http.Request, error) {
 	var err error
 
 	if u, err := url.Parse(nsPath); strings.HasPrefix(nsPath, "/") && err == nil {
@@ -101,7 +114,7 @@ func (ns *Netstorage) buildRequest(action, method, nsPath string) (*http.Request
 	mac.Write([]byte(acsAuthData + signString))
 	acsAuthSign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
 
-	request, err := http.NewRequest(method,
+	request, err := http.NewRequestWithContext(ctx, method,
 		fmt.Sprintf("http%s://%s%s", ns.Ssl, ns.Hostname, nsPath), nil)
 
 	if err != nil {
@@ -116,27 +129,69 @@ func (ns *Netstorage) buildRequest(action, method, nsPath string) (*http.Request
 	return request, nil
 }
 
-// submitRequest_EmptyBody submits an http request with empty body
-func (ns *Netstorage) submitRequest_EmptyBody(action, method, nsPath string) (*http.Response, error) {
-	request, err := ns.buildRequest(action, method, nsPath)
-	if err != nil {
-		response, err := ns.Client.Do(request)
+// StatusError is returned when a NetStorage HTTP call fails with a
+// non-2xx status, carrying the status code so callers can distinguish
+// e.g. a 404 from other failures without parsing resp.Status strings.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return e.Status
+}
+
+// IsNotFound reports whether err is a StatusError for a 404 response.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+// isRetriableError reports whether err is a transient network-level
+// failure (timeout, connection reset, DNS hiccup, ...) worth retrying
+// through the pacer, as opposed to a context cancellation.
+func isRetriableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Client.Do wraps a context error in a *url.Error.
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// submitRequest_EmptyBody submits an http request with empty body,
+// retrying transient failures through ns.Pacer.
+func (ns *Netstorage) submitRequest_EmptyBody(ctx context.Context, action, method, nsPath string) (*http.Response, error) {
+	var response *http.Response
+	err := ns.pacer().callWithPacer(ctx, func() (bool, time.Duration, error) {
+		request, err := ns.buildRequest(ctx, action, method, nsPath)
 		if err != nil {
-			return nil, err
+			return false, 0, err
 		}
-		if response.StatusCode/100 != 2 {
-			return response, errors.New(response.Status)
-		} else {
-			return response, nil
+		resp, err := ns.Client.Do(request)
+		if err != nil {
+			return isRetriableError(err), 0, err
 		}
-	} else {
+		if resp.StatusCode/100 != 2 {
+			retry := shouldRetryStatus(resp.StatusCode)
+			after := retryAfter(resp)
+			resp.Body.Close()
+			return retry, after, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		response = resp
+		return false, 0, nil
+	})
+	if err != nil {
 		return nil, err
 	}
+	return response, nil
 }
 
 // submitRequest_GetBody submits an http request with empty body, and returns the response body contents
-func (ns *Netstorage) submitRequest_GetBody(action, method, nsPath string) ([]byte, error) {
-	response, err := ns.submitRequest_EmptyBody(action, method, nsPath)
+func (ns *Netstorage) submitRequest_GetBody(ctx context.Context, action, method, nsPath string) ([]byte, error) {
+	response, err := ns.submitRequest_EmptyBody(ctx, action, method, nsPath)
 	if err == nil {
 		return readBody(response)
 	} else {
@@ -145,8 +200,8 @@ func (ns *Netstorage) submitRequest_GetBody(action, method, nsPath string) ([]by
 }
 
 // Du returns the disk usage information for a directory
-func (ns *Netstorage) Du(nsPath string) (*DuData, error) {
-	body, err := ns.submitRequest_GetBody("du&format=xml", "GET", nsPath)
+func (ns *Netstorage) Du(ctx context.Context, nsPath string) (*DuData, error) {
+	body, err := ns.submitRequest_GetBody(ctx, "du&format=xml", "GET", nsPath)
 	if err == nil {
 		var du DuData
 		if err = xml.Unmarshal(body, &du); err == nil {
@@ -160,8 +215,8 @@ func (ns *Netstorage) Du(nsPath string) (*DuData, error) {
 }
 
 // Stat returns the information about an object structure
-func (ns *Netstorage) Stat(nsPath string) (*StatData, error) {
-	body, err := ns.submitRequest_GetBody("stat&format=xml", "GET", nsPath)
+func (ns *Netstorage) Stat(ctx context.Context, nsPath string) (*StatData, error) {
+	body, err := ns.submitRequest_GetBody(ctx, "stat&format=xml", "GET", nsPath)
 	if err == nil {
 		var s StatData
 		if err = xml.Unmarshal(body, &s); err == nil {
@@ -175,20 +230,43 @@ func (ns *Netstorage) Stat(nsPath string) (*StatData, error) {
 }
 
 // Mkdir creates an empty directory
-func (ns *Netstorage) Mkdir(nsPath string) error {
-	_, err := ns.submitRequest_EmptyBody("mkdir", "POST", nsPath)
+func (ns *Netstorage) Mkdir(ctx context.Context, nsPath string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "mkdir", "POST", nsPath)
 	return err
 }
 
 // Rmdir deletes an empty directory
-func (ns *Netstorage) Rmdir(nsPath string) error {
-	_, err := ns.submitRequest_EmptyBody("rmdir", "POST", nsPath)
+func (ns *Netstorage) Rmdir(ctx context.Context, nsPath string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "rmdir", "POST", nsPath)
 	return err
 }
 
 // Dir returns the directory structure in XML format
-func (ns *Netstorage) Dir(nsPath string) (*StatData, error) {
-	body, err := ns.submitRequest_GetBody("dir&format=xml", "GET", nsPath)
+func (ns *Netstorage) Dir(ctx context.Context, nsPath string) (*StatData, error) {
+	body, err := ns.submitRequest_GetBody(ctx, "dir&format=xml", "GET", nsPath)
+	if err == nil {
+		var s StatData
+		if err = xml.Unmarshal(body, &s); err == nil {
+			return &s, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// List returns up to maxEntries entries of a directory structure,
+// starting after end (the last entry name returned by a previous
+// page, or "" for the first page), via NetStorage's paginated "list"
+// action. Callers detect the last page the usual cursor way: fewer
+// than maxEntries entries came back.
+func (ns *Netstorage) List(ctx context.Context, nsPath string, maxEntries int, end string) (*StatData, error) {
+	action := fmt.Sprintf("list&format=xml&max_entries=%d", maxEntries)
+	if end != "" {
+		action += "&end=" + url.QueryEscape(end)
+	}
+	body, err := ns.submitRequest_GetBody(ctx, action, "GET", nsPath)
 	if err == nil {
 		var s StatData
 		if err = xml.Unmarshal(body, &s); err == nil {
@@ -202,57 +280,103 @@ func (ns *Netstorage) Dir(nsPath string) (*StatData, error) {
 }
 
 // Mtime changes a fileâ€™s mtime
-func (ns *Netstorage) Mtime(nsPath string, mtime int64) error {
-	_, err := ns.submitRequest_EmptyBody(fmt.Sprintf("mtime&format=xml&mtime=%d", mtime), "POST", nsPath)
+func (ns *Netstorage) Mtime(ctx context.Context, nsPath string, mtime int64) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, fmt.Sprintf("mtime&format=xml&mtime=%d", mtime), "POST", nsPath)
 	return err
 }
 
 // Delete deletes an object/symbolic link
-func (ns *Netstorage) Delete(nsPath string) error {
-	_, err := ns.submitRequest_EmptyBody("delete", "POST", nsPath)
+func (ns *Netstorage) Delete(ctx context.Context, nsPath string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "delete", "POST", nsPath)
 	return err
 }
 
 // QuickDelete deletes a directory (i.e., recursively delete a directory tree)
 // In order to use this func, you need to the privilege on the CP Code.
-func (ns *Netstorage) QuickDelete(nsPath string) error {
-	_, err := ns.submitRequest_EmptyBody("quick-delete&quick-delete=imreallyreallysure", "POST", nsPath)
+func (ns *Netstorage) QuickDelete(ctx context.Context, nsPath string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "quick-delete&quick-delete=imreallyreallysure", "POST", nsPath)
 	return err
 }
 
 // Rename renames a file or symbolic link.
-func (ns *Netstorage) Rename(nsTarget, nsDestination string) error {
-	_, err := ns.submitRequest_EmptyBody("rename&destination="+url.QueryEscape(nsDestination), "POST", nsTarget)
+func (ns *Netstorage) Rename(ctx context.Context, nsTarget, nsDestination string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "rename&destination="+url.QueryEscape(nsDestination), "POST", nsTarget)
 	return err
 }
 
 // Symlink creates a symbolic link.
-func (ns *Netstorage) Symlink(nsTarget, nsDestination string) error {
-	_, err := ns.submitRequest_EmptyBody("symlink&target="+url.QueryEscape(nsTarget), "POST", nsDestination)
+func (ns *Netstorage) Symlink(ctx context.Context, nsTarget, nsDestination string) error {
+	_, err := ns.submitRequest_EmptyBody(ctx, "symlink&target="+url.QueryEscape(nsTarget), "POST", nsDestination)
 	return err
 }
 
 // Read submits a download request. Caller should get the contents from the response body
-func (ns *Netstorage) Read(path string) (*http.Response, error) {
+func (ns *Netstorage) Read(ctx context.Context, path string) (*http.Response, error) {
 	if strings.HasSuffix(path, "/") {
 		return nil, fmt.Errorf("[NetstorageError] Nestorage download path shouldn't be a directory: %s", path)
 	}
-	request, err := ns.buildRequest("download", "GET", path)
+	var response *http.Response
+	err := ns.pacer().callWithPacer(ctx, func() (bool, time.Duration, error) {
+		request, err := ns.buildRequest(ctx, "download", "GET", path)
+		if err != nil {
+			return false, 0, err
+		}
+		resp, err := ns.Client.Do(request)
+		if err != nil {
+			return isRetriableError(err), 0, err
+		}
+		if resp.StatusCode/100 != 2 {
+			retry := shouldRetryStatus(resp.StatusCode)
+			after := retryAfter(resp)
+			resp.Body.Close()
+			return retry, after, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		response = resp
+		return false, 0, nil
+	})
 	if err != nil {
-		return ns.Client.Do(request)
-	} else {
 		return nil, err
 	}
+	return response, nil
 }
 
-// Write submits an upload request, with the content given in the source reader
-func (ns *Netstorage) Write(source io.ReadCloser, destination string) error {
-	request, err := ns.buildRequest("upload", "PUT", destination)
-	if err != nil {
-		request.Body = source
-		_, err := ns.Client.Do(request)
-		return err
-	} else {
-		return err
-	}
+// Write submits an upload request, with the content given in the source
+// reader. source must support Seek so a retry can rewind and resend
+// the body from the start.
+func (ns *Netstorage) Write(ctx context.Context, source io.ReadSeeker, destination string) error {
+	return ns.uploadAction(ctx, "upload", source, destination)
+}
+
+// WriteHashed is like Write, but additionally tells NetStorage the
+// SHA-256 digest and exact size of the upload, via the sha256= and
+// size= X-Akamai-ACS-Action parameters. NetStorage rejects the upload
+// if the received content doesn't match, catching truncation and
+// corruption that a bare upload would miss.
+func (ns *Netstorage) WriteHashed(ctx context.Context, source io.ReadSeeker, destination, sha256Hex string, size int64) error {
+	action := fmt.Sprintf("upload&sha256=%s&size=%d", sha256Hex, size)
+	return ns.uploadAction(ctx, action, source, destination)
+}
+
+func (ns *Netstorage) uploadAction(ctx context.Context, action string, source io.ReadSeeker, destination string) error {
+	return ns.pacer().callWithPacer(ctx, func() (bool, time.Duration, error) {
+		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			return false, 0, err
+		}
+		request, err := ns.buildRequest(ctx, action, "PUT", destination)
+		if err != nil {
+			return false, 0, err
+		}
+		request.Body = ioutil.NopCloser(source)
+		resp, err := ns.Client.Do(request)
+		if err != nil {
+			return isRetriableError(err), 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			retry := shouldRetryStatus(resp.StatusCode)
+			after := retryAfter(resp)
+			return retry, after, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return false, 0, nil
+	})
 }
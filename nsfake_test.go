@@ -0,0 +1,356 @@
+package nsdriver
+
+// nsfake_test.go implements a tiny in-memory NetStorage server good
+// enough to drive Driver through the upstream storage driver
+// conformance suite. It understands the subset of
+// X-Akamai-ACS-Action verbs the driver actually issues, and verifies
+// the HMAC-SHA256 auth headers the same way real NetStorage would.
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fakeEntry struct {
+	isDir  bool
+	data   []byte
+	mtime  int64
+	target string
+}
+
+// fakeNetStorage is a map-backed tree of NetStorage objects (path to
+// *fakeEntry), served over HTTP by an httptest.Server.
+type fakeNetStorage struct {
+	mu      sync.Mutex
+	keyname string
+	key     string
+	tree    map[string]*fakeEntry
+}
+
+func newFakeNetStorage(keyname, key string) *fakeNetStorage {
+	return &fakeNetStorage{
+		keyname: keyname,
+		key:     key,
+		tree:    map[string]*fakeEntry{"/": {isDir: true}},
+	}
+}
+
+// verify checks the request's HMAC auth headers against the fake's key
+// material, exactly the way Netstorage.buildRequest signed them.
+func (f *fakeNetStorage) verify(r *http.Request) bool {
+	action := r.Header.Get("X-Akamai-ACS-Action")
+	authData := r.Header.Get("X-Akamai-ACS-Auth-Data")
+	authSign := r.Header.Get("X-Akamai-ACS-Auth-Sign")
+
+	signString := fmt.Sprintf("%s\nx-akamai-acs-action:%s\n", r.URL.RequestURI(), action)
+	mac := hmac.New(sha256.New, []byte(f.key))
+	mac.Write([]byte(authData + signString))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(authSign))
+}
+
+// ensureParents materializes implicit directory nodes for every path
+// component above p, the way real NetStorage creates intermediate
+// directories on upload/mkdir/symlink/rename instead of requiring
+// them to be created one at a time.
+func (f *fakeNetStorage) ensureParents(p string) {
+	dir := path.Dir(p)
+	for dir != "/" && dir != "." {
+		if _, ok := f.tree[dir]; ok {
+			return
+		}
+		f.tree[dir] = &fakeEntry{isDir: true, mtime: time.Now().Unix()}
+		dir = path.Dir(dir)
+	}
+}
+
+// verb extracts the action verb (stat, dir, upload, ...) and its
+// parameters out of the X-Akamai-ACS-Action header, which looks like
+// "version=1&action=stat&format=xml".
+func verb(action string) (string, url.Values) {
+	const marker = "action="
+	idx := strings.Index(action, marker)
+	if idx < 0 {
+		return "", nil
+	}
+	rest := action[idx+len(marker):]
+	name := rest
+	if amp := strings.Index(rest, "&"); amp >= 0 {
+		name = rest[:amp]
+		rest = rest[amp+1:]
+	} else {
+		rest = ""
+	}
+	values, _ := url.ParseQuery(rest)
+	return name, values
+}
+
+func (f *fakeNetStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.verify(r) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	name, values := verb(r.Header.Get("X-Akamai-ACS-Action"))
+	p := r.URL.Path
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch name {
+	case "upload":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if want := values.Get("size"); want != "" {
+			if n, err := strconv.Atoi(want); err == nil && n != len(body) {
+				http.Error(w, "size mismatch", http.StatusBadRequest)
+				return
+			}
+		}
+		f.tree[p] = &fakeEntry{data: body, mtime: time.Now().Unix()}
+		f.ensureParents(p)
+		w.WriteHeader(http.StatusOK)
+
+	case "download":
+		e, ok := f.tree[p]
+		if !ok || e.isDir {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write(e.data)
+
+	case "stat":
+		e, ok := f.tree[p]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		f.writeStat(w, p, e)
+
+	case "dir":
+		f.writeDir(w, p)
+
+	case "list":
+		maxEntries, _ := strconv.Atoi(values.Get("max_entries"))
+		f.writeList(w, p, maxEntries, values.Get("end"))
+
+	case "du":
+		var files, bytesUsed uint64
+		prefix := strings.TrimSuffix(p, "/") + "/"
+		for k, e := range f.tree {
+			if strings.HasPrefix(k, prefix) && !e.isDir {
+				files++
+				bytesUsed += uint64(len(e.data))
+			}
+		}
+		var du DuData
+		du.Dir = p
+		du.DUInfo.Files = files
+		du.DUInfo.Bytes = bytesUsed
+		writeXML(w, &du)
+
+	case "mkdir":
+		f.tree[p] = &fakeEntry{isDir: true, mtime: time.Now().Unix()}
+		f.ensureParents(p)
+		w.WriteHeader(http.StatusOK)
+
+	case "rmdir":
+		e, ok := f.tree[p]
+		if !ok || !e.isDir {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(f.tree, p)
+		w.WriteHeader(http.StatusOK)
+
+	case "delete":
+		if _, ok := f.tree[p]; !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		delete(f.tree, p)
+		w.WriteHeader(http.StatusOK)
+
+	case "quick-delete":
+		prefix := strings.TrimSuffix(p, "/") + "/"
+		for k := range f.tree {
+			if k == p || strings.HasPrefix(k, prefix) {
+				delete(f.tree, k)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case "rename":
+		e, ok := f.tree[p]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		dest := values.Get("destination")
+		delete(f.tree, p)
+		f.tree[dest] = e
+		f.ensureParents(dest)
+		w.WriteHeader(http.StatusOK)
+
+	case "symlink":
+		f.tree[p] = &fakeEntry{target: values.Get("target"), mtime: time.Now().Unix()}
+		f.ensureParents(p)
+		w.WriteHeader(http.StatusOK)
+
+	case "mtime":
+		e, ok := f.tree[p]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if mt, err := strconv.ParseInt(values.Get("mtime"), 10, 64); err == nil {
+			e.mtime = mt
+		}
+		f.writeStat(w, p, e)
+
+	default:
+		http.Error(w, "unsupported action: "+name, http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeNetStorage) writeStat(w http.ResponseWriter, p string, e *fakeEntry) {
+	var s StatData
+	s.Dir = path.Dir(p)
+	entry := StatEntry{
+		Name:  path.Base(p),
+		Mtime: uint64(e.mtime),
+	}
+	switch {
+	case e.isDir:
+		entry.Type = "dir"
+	case e.target != "":
+		entry.Type = "symlink"
+		entry.Target = e.target
+	default:
+		entry.Type = "file"
+		entry.Size = uint64(len(e.data))
+		entry.MD5 = md5Hex(e.data)
+	}
+	s.Files = []StatEntry{entry}
+	writeXML(w, &s)
+}
+
+func (f *fakeNetStorage) writeDir(w http.ResponseWriter, p string) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	var s StatData
+	s.Dir = p
+	for k, e := range f.tree {
+		if k == p || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if strings.Contains(rest, "/") {
+			continue
+		}
+		entry := StatEntry{Name: rest, Mtime: uint64(e.mtime)}
+		if e.isDir {
+			entry.Type = "dir"
+		} else {
+			entry.Type = "file"
+			entry.Size = uint64(len(e.data))
+			entry.MD5 = md5Hex(e.data)
+		}
+		s.Files = append(s.Files, entry)
+	}
+	writeXML(w, &s)
+}
+
+// writeList serves the paginated "list" action: entries are sorted by
+// name so "end" (the last name from a previous page) can be used as a
+// stable resume cursor, then up to maxEntries of them following end
+// are returned.
+func (f *fakeNetStorage) writeList(w http.ResponseWriter, p string, maxEntries int, end string) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	var names []string
+	for k := range f.tree {
+		if k == p || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if strings.Contains(rest, "/") {
+			continue
+		}
+		names = append(names, rest)
+	}
+	sort.Strings(names)
+
+	start := 0
+	if end != "" {
+		start = sort.SearchStrings(names, end)
+		if start < len(names) && names[start] == end {
+			start++
+		}
+	}
+
+	var s StatData
+	s.Dir = p
+	for _, name := range names[start:] {
+		if maxEntries > 0 && len(s.Files) >= maxEntries {
+			break
+		}
+		e := f.tree[prefix+name]
+		entry := StatEntry{Name: name, Mtime: uint64(e.mtime)}
+		if e.isDir {
+			entry.Type = "dir"
+		} else {
+			entry.Type = "file"
+			entry.Size = uint64(len(e.data))
+			entry.MD5 = md5Hex(e.data)
+		}
+		s.Files = append(s.Files, entry)
+	}
+	writeXML(w, &s)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(body)
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newFakeNetStorageServer starts an httptest.Server backed by a fresh
+// fakeNetStorage tree, and returns a *Netstorage wired up to talk to it.
+func newFakeNetStorageServer(keyname, key string) (*httptest.Server, *Netstorage) {
+	fake := newFakeNetStorage(keyname, key)
+	server := httptest.NewServer(fake)
+	ns := &Netstorage{
+		Hostname: strings.TrimPrefix(server.URL, "http://"),
+		Keyname:  keyname,
+		Key:      key,
+		Ssl:      "",
+		Client:   server.Client(),
+		Pacer:    NewPacer(),
+	}
+	return server, ns
+}
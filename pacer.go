@@ -0,0 +1,157 @@
+package nsdriver
+
+// pacer implements an rclone-style pacing strategy for NetStorage HTTP
+// calls: sleep between calls, doubling the sleep time on failure and
+// halving it on success, so a burst of transient errors backs off
+// instead of hammering the API.
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMinSleep      = 10 * time.Millisecond
+	defaultMaxSleep      = 2 * time.Second
+	defaultDecayConstant = 2
+	defaultMaxRetries    = 10
+)
+
+// Pacer paces calls to NetStorage, retrying failed calls with an
+// exponentially increasing delay bounded by MinSleep and MaxSleep.
+type Pacer struct {
+	MinSleep      time.Duration
+	MaxSleep      time.Duration
+	DecayConstant uint
+
+	// MaxRetries bounds the number of retries callWithPacer makes
+	// after the first attempt before giving up (MaxRetries+1 attempts
+	// in all), so a context with no deadline can't loop
+	// forever against a server that never stops answering 503.
+	MaxRetries uint
+
+	sleepTime time.Duration
+}
+
+// NewPacer creates a Pacer using the package default min/max sleep and
+// decay constant.
+func NewPacer() *Pacer {
+	return &Pacer{
+		MinSleep:      defaultMinSleep,
+		MaxSleep:      defaultMaxSleep,
+		DecayConstant: defaultDecayConstant,
+		MaxRetries:    defaultMaxRetries,
+		sleepTime:     defaultMinSleep,
+	}
+}
+
+// wait sleeps for the pacer's current sleep time (with jitter),
+// returning early if ctx is done.
+func (p *Pacer) wait(ctx context.Context) error {
+	sleepTime := p.sleepTime
+	if sleepTime <= 0 {
+		return nil
+	}
+	jitter := time.Duration(rand.Int63n(int64(sleepTime)))
+	select {
+	case <-time.After(jitter):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// success halves the sleep time, bounded by MinSleep.
+func (p *Pacer) success() {
+	decay := time.Duration(p.DecayConstant)
+	if decay < 1 {
+		decay = 1
+	}
+	p.sleepTime /= decay
+	if p.sleepTime < p.MinSleep {
+		p.sleepTime = p.MinSleep
+	}
+}
+
+// failure doubles the sleep time, bounded by MaxSleep, or jumps
+// straight to "after" if the server told us how long to wait.
+func (p *Pacer) failure(after time.Duration) {
+	decay := time.Duration(p.DecayConstant)
+	if decay < 1 {
+		decay = 1
+	}
+	next := p.sleepTime * decay
+	if after > next {
+		next = after
+	}
+	if next > p.MaxSleep {
+		next = p.MaxSleep
+	}
+	if next < p.MinSleep {
+		next = p.MinSleep
+	}
+	p.sleepTime = next
+}
+
+// callWithPacer calls f, retrying with backoff while f reports
+// retry=true. f also returns the delay the server asked for via
+// Retry-After (zero if none); callWithPacer is the only place that
+// calls p.failure, so a single retriable response backs off exactly
+// once. It gives up once ctx is done or MaxRetries is exhausted.
+func (p *Pacer) callWithPacer(ctx context.Context, f func() (bool, time.Duration, error)) error {
+	maxRetries := p.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	for attempt := uint(0); ; attempt++ {
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+		retry, after, err := f()
+		if !retry {
+			p.success()
+			return err
+		}
+		p.failure(after)
+		if ctx.Err() != nil {
+			return err
+		}
+		if attempt >= maxRetries {
+			return err
+		}
+	}
+}
+
+// shouldRetryStatus reports whether an HTTP response with the given
+// status code represents a transient failure worth retrying: 429 and
+// any 5xx except 501 Not Implemented, which is never transient.
+func shouldRetryStatus(code int) bool {
+	if code == http.StatusTooManyRequests {
+		return true
+	}
+	return code >= 500 && code != http.StatusNotImplemented
+}
+
+// retryAfter extracts the delay requested by a Retry-After header, if
+// present, in either delta-seconds or HTTP-date form.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package nsdriver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingRoundTripper fails the first failCount requests with the
+// given status code (and Retry-After header, if set), then succeeds.
+type countingRoundTripper struct {
+	status     int
+	retryAfter string
+	failCount  int
+	seen       int
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.seen++
+	if rt.seen <= rt.failCount {
+		resp := &http.Response{
+			StatusCode: rt.status,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}
+		if rt.retryAfter != "" {
+			resp.Header.Set("Retry-After", rt.retryAfter)
+		}
+		return resp, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("<stat/>")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func newTestNetstorage(rt http.RoundTripper) *Netstorage {
+	ns := NewNetstorage("host", "kn", "k", false)
+	ns.Client = &http.Client{Transport: rt}
+	ns.Pacer.MinSleep = time.Millisecond
+	ns.Pacer.MaxSleep = 5 * time.Millisecond
+	return ns
+}
+
+func TestSubmitRequestRetriesOn503(t *testing.T) {
+	rt := &countingRoundTripper{status: http.StatusServiceUnavailable, failCount: 2}
+	ns := newTestNetstorage(rt)
+
+	_, err := ns.submitRequest_EmptyBody(context.Background(), "stat&format=xml", "GET", "/cpcode/path")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rt.seen != 3 {
+		t.Errorf("Expected 3 attempts, got %d", rt.seen)
+	}
+}
+
+func TestSubmitRequestRetriesOn429(t *testing.T) {
+	rt := &countingRoundTripper{status: http.StatusTooManyRequests, failCount: 1}
+	ns := newTestNetstorage(rt)
+
+	_, err := ns.submitRequest_EmptyBody(context.Background(), "stat&format=xml", "GET", "/cpcode/path")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if rt.seen != 2 {
+		t.Errorf("Expected 2 attempts, got %d", rt.seen)
+	}
+}
+
+func TestSubmitRequestDoesNotRetryOn501(t *testing.T) {
+	rt := &countingRoundTripper{status: http.StatusNotImplemented, failCount: 100}
+	ns := newTestNetstorage(rt)
+
+	_, err := ns.submitRequest_EmptyBody(context.Background(), "stat&format=xml", "GET", "/cpcode/path")
+	if err == nil {
+		t.Errorf("Expected error, got nil")
+	}
+	if rt.seen != 1 {
+		t.Errorf("Expected 1 attempt, got %d", rt.seen)
+	}
+}
+
+func TestSubmitRequestHonorsContextCancellation(t *testing.T) {
+	rt := &countingRoundTripper{status: http.StatusServiceUnavailable, failCount: 100}
+	ns := newTestNetstorage(rt)
+	ns.Pacer.MinSleep = 50 * time.Millisecond
+	ns.Pacer.MaxSleep = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := ns.submitRequest_EmptyBody(ctx, "stat&format=xml", "GET", "/cpcode/path")
+	if err == nil {
+		t.Errorf("Expected error from context cancellation, got nil")
+	}
+}
+
+func TestPacerBackoffDoublesAndHalves(t *testing.T) {
+	p := NewPacer()
+	p.MinSleep = time.Millisecond
+	p.MaxSleep = 100 * time.Millisecond
+	p.DecayConstant = 2
+
+	start := p.sleepTime
+	p.failure(0)
+	if p.sleepTime != start*2 {
+		t.Errorf("Expected sleep time to double to %s, got %s", start*2, p.sleepTime)
+	}
+	p.success()
+	if p.sleepTime != start {
+		t.Errorf("Expected sleep time to halve back to %s, got %s", start, p.sleepTime)
+	}
+}
@@ -0,0 +1,49 @@
+package nsdriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+func TestURLForUnsupportedWithoutEdgeTokenKey(t *testing.T) {
+	_, ns := newFakeNetStorageServer("kn", "k")
+	d := &Driver{ns: ns}
+	d.GetNameFunc = func(ctx context.Context, dd *Driver, nm string) (string, bool) { return nm, false }
+
+	_, err := d.URLFor(context.Background(), "/cp/foo", nil)
+	if _, ok := err.(storagedriver.ErrUnsupportedMethod); !ok {
+		t.Errorf("Expected ErrUnsupportedMethod, got %v", err)
+	}
+}
+
+func TestURLForSignsWithEdgeTokenKey(t *testing.T) {
+	_, ns := newFakeNetStorageServer("kn", "k")
+	d := &Driver{ns: ns, EdgeHostname: "edge.example.com", EdgeTokenKey: "tokensecret"}
+	d.GetNameFunc = func(ctx context.Context, dd *Driver, nm string) (string, bool) { return nm, false }
+
+	u, err := d.URLFor(context.Background(), "/cp/foo", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(u, "https://edge.example.com/cp/foo?auth=") {
+		t.Errorf("Wrong url: %s", u)
+	}
+}
+
+func TestURLForIncludesIPWhenPinned(t *testing.T) {
+	_, ns := newFakeNetStorageServer("kn", "k")
+	d := &Driver{ns: ns, EdgeHostname: "edge.example.com", EdgeTokenKey: "tokensecret"}
+	d.GetNameFunc = func(ctx context.Context, dd *Driver, nm string) (string, bool) { return nm, false }
+
+	unpinned, _ := d.URLFor(context.Background(), "/cp/foo", nil)
+	pinned, _ := d.URLFor(context.Background(), "/cp/foo", map[string]interface{}{"ip": "10.0.0.1"})
+	if unpinned == pinned {
+		t.Errorf("Expected IP-pinned URL to differ from unpinned URL")
+	}
+	if !strings.Contains(pinned, "10.0.0.1") {
+		t.Errorf("Expected pinned URL to include the IP: %s", pinned)
+	}
+}
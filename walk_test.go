@@ -0,0 +1,116 @@
+package nsdriver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	storagedriver "github.com/docker/distribution/registry/storage/driver"
+)
+
+func newWalkTestDriver() *Driver {
+	_, ns := newFakeNetStorageServer("kn", "k")
+	d := &Driver{ns: ns, TempFileFunc: LocalTempFileWriterFunc}
+	d.GetNameFunc = func(ctx context.Context, dd *Driver, nm string) (string, bool) { return nm, false }
+	return d
+}
+
+func TestWalkVisitsTreeDepthFirst(t *testing.T) {
+	d := newWalkTestDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/cp/a/one.txt", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := d.PutContent(ctx, "/cp/a/b/two.txt", []byte("2")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var visited []string
+	err := d.Walk(ctx, "/cp/a", func(fi storagedriver.FileInfo) error {
+		visited = append(visited, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(visited) != 3 {
+		t.Errorf("Expected 3 entries (one.txt, b/, b/two.txt), got %v", visited)
+	}
+}
+
+func TestWalkSkipDir(t *testing.T) {
+	d := newWalkTestDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/cp/a/b/two.txt", []byte("2")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := d.PutContent(ctx, "/cp/a/one.txt", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var visited []string
+	err := d.Walk(ctx, "/cp/a", func(fi storagedriver.FileInfo) error {
+		visited = append(visited, fi.Path())
+		if fi.IsDir() {
+			return storagedriver.ErrSkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, v := range visited {
+		if v == "/cp/a/b/two.txt" {
+			t.Errorf("Expected to skip descending into b/, but visited %s", v)
+		}
+	}
+}
+
+func TestWalkPagesThroughLargeDirectory(t *testing.T) {
+	d := newWalkTestDriver()
+	d.Options = map[string]interface{}{"walkPageSize": 2}
+	ctx := context.Background()
+
+	const total = 5
+	for i := 0; i < total; i++ {
+		name := fmt.Sprintf("/cp/a/%02d.txt", i)
+		if err := d.PutContent(ctx, name, []byte("x")); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	var visited []string
+	err := d.Walk(ctx, "/cp/a", func(fi storagedriver.FileInfo) error {
+		visited = append(visited, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(visited) != total {
+		t.Errorf("Expected %d entries across pages smaller than the directory, got %v", total, visited)
+	}
+}
+
+func TestChangeMtime(t *testing.T) {
+	d := newWalkTestDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/cp/f.txt", []byte("x")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := time.Unix(12345, 0)
+	if err := d.ChangeMtime(ctx, "/cp/f.txt", want); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	fi, err := d.Stat(ctx, "/cp/f.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !fi.ModTime().Equal(want) {
+		t.Errorf("Wrong mtime: got %s want %s", fi.ModTime(), want)
+	}
+}